@@ -0,0 +1,59 @@
+package chaincmd
+
+import (
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var pruneStateCommand = cli.Command{
+	Action:    utils.MigrateFlags(pruneState),
+	Name:      "prune-state",
+	Usage:     "Reconstruct live state from a snapshot and prune everything else",
+	ArgsUsage: "",
+	Category:  "SNAPSHOT COMMANDS",
+	Flags: []cli.Flag{
+		utils.DataDirFlag,
+	},
+	Description: `
+turbo-geth snapshot prune-state reconstructs the set of live account/storage
+trie nodes from the current head snapshot and deletes everything else,
+keeping the genesis state live alongside the head's. Unlike the pruner that
+runs alongside the node, this is an offline, one-shot reclaim of
+historic-state disk usage and is crash-safe: if interrupted, re-running the
+command repeats the whole prune against the same target root, and refuses to
+prune towards a different root while that one is unfinished.
+
+Intermediate trie hash caches (TrieOfAccountsBucket/TrieOfStorageBucket) are
+always dropped wholesale rather than pruned selectively, since they are a
+pure, regenerable derived cache - so the first read or write after running
+this forces a full trie-root recompute from the hashed state.`,
+}
+
+func pruneState(ctx *cli.Context) error {
+	stack := makeConfigNode(ctx)
+	defer stack.Close()
+
+	chaindb := utils.MakeChainDatabase(ctx, stack)
+	defer chaindb.Close()
+
+	headHash := rawdb.ReadHeadBlockHash(chaindb)
+	headHeader := rawdb.ReadHeader(chaindb, headHash, rawdb.ReadHeaderNumber(chaindb, headHash))
+	if headHeader == nil {
+		log.Error("Failed to read head header, aborting")
+		return nil
+	}
+
+	genesisHash := rawdb.ReadCanonicalHash(chaindb, 0)
+	genesisHeader := rawdb.ReadHeader(chaindb, genesisHash, 0)
+	genesisRoot := common.Hash{}
+	if genesisHeader != nil {
+		genesisRoot = genesisHeader.Root
+	}
+
+	pruner := core.NewOfflinePruner(chaindb, genesisRoot)
+	return pruner.Prune(headHeader.Root)
+}
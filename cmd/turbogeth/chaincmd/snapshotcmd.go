@@ -0,0 +1,14 @@
+package chaincmd
+
+import "gopkg.in/urfave/cli.v1"
+
+// SnapshotCommand groups every `turbo-geth snapshot <sub>` command, so
+// main.go only has to register this single entry in its app.Commands list.
+var SnapshotCommand = cli.Command{
+	Name:     "snapshot",
+	Usage:    "A set of commands based on the snapshot",
+	Category: "SNAPSHOT COMMANDS",
+	Subcommands: []cli.Command{
+		pruneStateCommand,
+	},
+}
@@ -0,0 +1,54 @@
+package core
+
+import "time"
+
+// CacheConfig configures the trie cache and the state/history pruner
+// (BasicPruner) that runs alongside it. Only the fields BasicPruner and its
+// ancillary freezer actually consume are declared here.
+type CacheConfig struct {
+	// BlocksToPrune caps how many blocks' worth of history BasicPruner
+	// prunes in a single pass, across every data class.
+	BlocksToPrune uint64
+	// PruneTimeout is how often BasicPruner's pruning loop wakes up to
+	// check whether there is a new window to prune.
+	PruneTimeout time.Duration
+
+	// PruneBufferLimit bounds how many bytes of pending delete keys
+	// BasicPruner buffers in memory before scheduling them for deletion.
+	// Zero uses defaultPruneBufferLimit.
+	PruneBufferLimit uint64
+
+	// AccountHistoryRetention, StorageHistoryRetention,
+	// TransactionHistoryRetention, ReceiptRetention and
+	// IntermediateTrieHashRetention are per-data-class retention windows,
+	// in blocks, replacing the single global BlocksBeforePruning knob:
+	// e.g. an RPC-serving node can keep 90 days of transactions/receipts
+	// for eth_getTransactionByHash while aggressively pruning intermediate
+	// trie hashes, which one shared window cannot express.
+	AccountHistoryRetention       uint64
+	StorageHistoryRetention       uint64
+	TransactionHistoryRetention   uint64
+	ReceiptRetention              uint64
+	IntermediateTrieHashRetention uint64
+
+	// StorageHistoryChopMode enables thin-history pruning for storage
+	// change sets: instead of deleting a whole StorageHistoryBucket index
+	// chunk, the pruned block range is chopped out of its roaring bitmap
+	// and the chunk is rewritten, preserving history for blocks outside
+	// the pruned range that the same chunk still covers.
+	StorageHistoryChopMode bool
+
+	// Freezer configures the ancient/frozen block-segment store. A nil
+	// Freezer (or one with an empty Path) disables freezing: blocks are
+	// pruned straight out of the live database with no ancient copy kept.
+	Freezer *FreezerConfig
+	// BlocksBeforeFreezing is how many confirmations a block needs before
+	// BasicPruner moves its header/body/receipts into the freezer, ahead of
+	// that block's change sets becoming eligible for pruning.
+	BlocksBeforeFreezing uint64
+
+	// PruneMode selects whether Prune blocks until its batches commit
+	// (PruneModeSync, the default) or schedules them and lets the next
+	// tick start walking immediately (PruneModeAsync).
+	PruneMode PruneMode
+}
@@ -0,0 +1,286 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+)
+
+// FreezerConfig configures the ancient/frozen block-segment store that sits
+// alongside CacheConfig. Blocks older than BlocksBeforeFreezing are appended
+// to these append-only segment files before their change sets become
+// eligible for deletion, so historic header/body/receipt data survives
+// pruning on disk instead of being thrown away.
+type FreezerConfig struct {
+	// Path is the directory ancient segment files live under. An empty Path
+	// disables freezing entirely.
+	Path string
+}
+
+// freezerLayoutVersion guards against an older/newer turbo-geth silently
+// reusing an ancient directory laid out differently.
+const freezerLayoutVersion = 1
+
+const freezerVersionFile = "FREEZER_VERSION"
+
+// freezerProgressKey persists, as a pair of big-endian uint64s, the last
+// block number MoveToAncient fully froze and the resulting item count each
+// of headers/bodies/receipts held at that moment. The three tables are
+// always appended as a triple, so a single item count is enough to
+// describe all of them: on restart every table is truncated back to it
+// (see freezer.truncateTo), which discards any dangling entry a crash left
+// behind between two of a triple's three appends instead of resuming with
+// the tables desynchronized.
+var freezerProgressKey = []byte("freezer-last-frozen-block")
+
+// freezerProgress is the decoded form of freezerProgressKey.
+type freezerProgress struct {
+	blockNum  uint64
+	itemCount uint64
+}
+
+// freezer is the set of append-only segment tables backing FreezerConfig,
+// one file per data class, each holding one item per frozen block in
+// ascending block order. An item's position is not its block number: block 0
+// is never frozen, and blocks with no canonical hash are skipped.
+type freezer struct {
+	mu       sync.Mutex
+	headers  *freezerTable
+	bodies   *freezerTable
+	receipts *freezerTable
+}
+
+func openFreezer(ancientPath string) (*freezer, error) {
+	chainDir := filepath.Join(ancientPath, "chain")
+	if err := checkFreezerLayout(chainDir); err != nil {
+		return nil, err
+	}
+
+	headers, err := openFreezerTable(chainDir, "headers")
+	if err != nil {
+		return nil, err
+	}
+	bodies, err := openFreezerTable(chainDir, "bodies")
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := openFreezerTable(chainDir, "receipts")
+	if err != nil {
+		return nil, err
+	}
+	return &freezer{headers: headers, bodies: bodies, receipts: receipts}, nil
+}
+
+// checkFreezerLayout makes sure an existing ancient/chain directory was
+// written by a compatible layout version before anything is appended to it,
+// so an upgrade (or downgrade) never silently mixes incompatible segments.
+func checkFreezerLayout(chainDir string) error {
+	if err := os.MkdirAll(chainDir, 0755); err != nil {
+		return err
+	}
+	versionPath := filepath.Join(chainDir, freezerVersionFile)
+	data, err := ioutil.ReadFile(versionPath)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(versionPath, []byte(fmt.Sprintf("%d", freezerLayoutVersion)), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if string(data) != fmt.Sprintf("%d", freezerLayoutVersion) {
+		return fmt.Errorf("ancient directory %q was written by an incompatible freezer layout (found %q, want %d)", chainDir, data, freezerLayoutVersion)
+	}
+	return nil
+}
+
+// truncateTo rolls headers, bodies and receipts back to exactly itemCount
+// entries each. Called once on startup with the last durably-committed
+// itemCount, it is a no-op if the previous run shut down cleanly, and a
+// real rollback if it crashed partway through a triple - bringing all
+// three tables back into alignment before MoveToAncient resumes appending.
+func (f *freezer) truncateTo(itemCount uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.headers.truncate(itemCount); err != nil {
+		return err
+	}
+	if err := f.bodies.truncate(itemCount); err != nil {
+		return err
+	}
+	return f.receipts.truncate(itemCount)
+}
+
+func (f *freezer) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.headers.close(); err != nil {
+		return err
+	}
+	if err := f.bodies.close(); err != nil {
+		return err
+	}
+	return f.receipts.close()
+}
+
+// freezerTable is a minimal append-only segment: a flat data file holding
+// concatenated RLP blobs, and an index file holding the cumulative end
+// offset (8 bytes, big-endian) of every appended item so it can be sliced
+// back out by position later.
+type freezerTable struct {
+	data *os.File
+	idx  *os.File
+}
+
+func openFreezerTable(dir, name string) (*freezerTable, error) {
+	data, err := os.OpenFile(filepath.Join(dir, name+".dat"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := os.OpenFile(filepath.Join(dir, name+".idx"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		data.Close() //nolint:errcheck
+		return nil, err
+	}
+	return &freezerTable{data: data, idx: idx}, nil
+}
+
+func (t *freezerTable) append(item []byte) error {
+	offset, err := t.data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := t.data.Write(item); err != nil {
+		return err
+	}
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(end, uint64(offset)+uint64(len(item)))
+	_, err = t.idx.Write(end)
+	return err
+}
+
+// count reports how many items are currently recorded in the table's index.
+func (t *freezerTable) count() (uint64, error) {
+	info, err := t.idx.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()) / 8, nil
+}
+
+// truncate rolls the table back to exactly n items, dropping anything
+// appended after item n-1. It is a no-op if the table already has n or
+// fewer items.
+func (t *freezerTable) truncate(n uint64) error {
+	count, err := t.count()
+	if err != nil {
+		return err
+	}
+	if count <= n {
+		return nil
+	}
+
+	dataEnd := int64(0)
+	if n > 0 {
+		end := make([]byte, 8)
+		if _, err := t.idx.ReadAt(end, int64((n-1)*8)); err != nil {
+			return err
+		}
+		dataEnd = int64(binary.BigEndian.Uint64(end))
+	}
+	if err := t.data.Truncate(dataEnd); err != nil {
+		return err
+	}
+	return t.idx.Truncate(int64(n * 8))
+}
+
+func (t *freezerTable) close() error {
+	if err := t.data.Close(); err != nil {
+		return err
+	}
+	return t.idx.Close()
+}
+
+// MoveToAncient appends the header, body and receipts of every block in
+// [from, to] to the configured ancient directory, then schedules their live
+// KV entries for deletion through the usual buffered-flush pipeline. It is
+// meant to run immediately before Prune, so a block's change sets are only
+// ever deleted once its canonical data has safely reached the freezer.
+//
+// freezerProgressKey only advances once all three of a block's appends have
+// committed, so a crash between two of them leaves the tables holding a
+// dangling entry for that block with no corresponding progress record;
+// Start's call to freezer.truncateTo rolls that dangling entry back off on
+// the next startup before this resumes.
+func (p *BasicPruner) MoveToAncient(from, to uint64) error {
+	if p.freezer == nil {
+		return nil
+	}
+	p.freezer.mu.Lock()
+	defer p.freezer.mu.Unlock()
+
+	itemCount, err := p.freezer.headers.count()
+	if err != nil {
+		return err
+	}
+
+	for num := from; num <= to; num++ {
+		hash := rawdb.ReadCanonicalHash(p.db, num)
+		if hash == (common.Hash{}) {
+			continue
+		}
+		headerRLP := rawdb.ReadHeaderRLP(p.db, hash, num)
+		bodyRLP := rawdb.ReadBodyRLP(p.db, hash, num)
+		receiptsRLP := rawdb.ReadReceiptsRLP(p.db, hash, num)
+
+		if err := p.freezer.headers.append(headerRLP); err != nil {
+			return fmt.Errorf("freezing header %d: %w", num, err)
+		}
+		if err := p.freezer.bodies.append(bodyRLP); err != nil {
+			return fmt.Errorf("freezing body %d: %w", num, err)
+		}
+		if err := p.freezer.receipts.append(receiptsRLP); err != nil {
+			return fmt.Errorf("freezing receipts %d: %w", num, err)
+		}
+		itemCount++
+
+		// Only past this point are all three tables durably aligned for
+		// num - persist that before moving on, so a crash before the next
+		// triple completes rolls back to here, not partway through it.
+		if err := p.writeFreezerProgress(num, itemCount); err != nil {
+			return err
+		}
+
+		p.pushKey(dbutils.HeaderPrefix, dbutils.HeaderKey(num, hash))
+		p.pushKey(dbutils.BlockBodyPrefix, dbutils.BlockBodyKey(num, hash))
+		p.pushKey(dbutils.BlockReceiptsPrefix, dbutils.BlockReceiptsKey(num, hash))
+	}
+
+	p.Flush()
+	p.WaitFlushed()
+	return nil
+}
+
+func (p *BasicPruner) readFreezerProgress() freezerProgress {
+	data, _ := p.db.Get(dbutils.DatabaseInfoBucket, freezerProgressKey)
+	if len(data) != 16 {
+		return freezerProgress{}
+	}
+	return freezerProgress{
+		blockNum:  binary.BigEndian.Uint64(data[:8]),
+		itemCount: binary.BigEndian.Uint64(data[8:]),
+	}
+}
+
+func (p *BasicPruner) writeFreezerProgress(blockNum, itemCount uint64) error {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], blockNum)
+	binary.BigEndian.PutUint64(b[8:], itemCount)
+	return p.db.Put(dbutils.DatabaseInfoBucket, freezerProgressKey, b)
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFreezerTable(t *testing.T) *freezerTable {
+	t.Helper()
+	dir := t.TempDir()
+	table, err := openFreezerTable(dir, "test")
+	if err != nil {
+		t.Fatalf("openFreezerTable: %v", err)
+	}
+	t.Cleanup(func() {
+		table.close() //nolint:errcheck
+	})
+	return table
+}
+
+func TestFreezerTableAppendAndCount(t *testing.T) {
+	table := newTestFreezerTable(t)
+
+	for i, item := range [][]byte{[]byte("one"), []byte("two"), []byte("three")} {
+		if err := table.append(item); err != nil {
+			t.Fatalf("append item %d: %v", i, err)
+		}
+	}
+
+	count, err := table.count()
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("count = %d, want 3", count)
+	}
+}
+
+func TestFreezerTableTruncateDropsDanglingEntries(t *testing.T) {
+	table := newTestFreezerTable(t)
+
+	for _, item := range [][]byte{[]byte("a"), []byte("bb"), []byte("ccc"), []byte("dddd")} {
+		if err := table.append(item); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	if err := table.truncate(2); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	count, err := table.count()
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("count after truncate = %d, want 2", count)
+	}
+
+	if err := table.append([]byte("ee")); err != nil {
+		t.Fatalf("append after truncate: %v", err)
+	}
+	count, err = table.count()
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("count after append post-truncate = %d, want 3", count)
+	}
+}
+
+func TestFreezerTableTruncateIsNoopWhenAlreadyShortEnough(t *testing.T) {
+	table := newTestFreezerTable(t)
+
+	if err := table.append([]byte("solo")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	if err := table.truncate(5); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	count, err := table.count()
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("count = %d, want 1", count)
+	}
+}
+
+func TestFreezerTruncateToRealignsAllThreeTables(t *testing.T) {
+	dir := t.TempDir()
+	f, err := openFreezer(dir)
+	if err != nil {
+		t.Fatalf("openFreezer: %v", err)
+	}
+	defer f.close() //nolint:errcheck
+
+	for _, item := range [][]byte{[]byte("h0"), []byte("h1")} {
+		if err := f.headers.append(item); err != nil {
+			t.Fatalf("headers.append: %v", err)
+		}
+	}
+	for _, item := range [][]byte{[]byte("b0"), []byte("b1")} {
+		if err := f.bodies.append(item); err != nil {
+			t.Fatalf("bodies.append: %v", err)
+		}
+	}
+	for _, item := range [][]byte{[]byte("r0"), []byte("r1")} {
+		if err := f.receipts.append(item); err != nil {
+			t.Fatalf("receipts.append: %v", err)
+		}
+	}
+	// Simulate a crash that appended a header and a body for block 2 but
+	// never reached the receipts table, leaving the triple desynchronized.
+	if err := f.headers.append([]byte("h2")); err != nil {
+		t.Fatalf("headers.append: %v", err)
+	}
+	if err := f.bodies.append([]byte("b2")); err != nil {
+		t.Fatalf("bodies.append: %v", err)
+	}
+
+	if err := f.truncateTo(2); err != nil {
+		t.Fatalf("truncateTo: %v", err)
+	}
+
+	for name, table := range map[string]*freezerTable{"headers": f.headers, "bodies": f.bodies, "receipts": f.receipts} {
+		count, err := table.count()
+		if err != nil {
+			t.Fatalf("%s.count: %v", name, err)
+		}
+		if count != 2 {
+			t.Errorf("%s count after truncateTo(2) = %d, want 2", name, count)
+		}
+	}
+
+	// Sanity check the on-disk layout version file was written.
+	data, err := ioutil.ReadFile(filepath.Join(dir, "chain", freezerVersionFile))
+	if err != nil {
+		t.Fatalf("reading %s: %v", freezerVersionFile, err)
+	}
+	if want := fmt.Sprintf("%d", freezerLayoutVersion); string(data) != want {
+		t.Errorf("%s = %q, want %q", freezerVersionFile, data, want)
+	}
+}
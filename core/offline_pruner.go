@@ -0,0 +1,255 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/holiman/bloomfilter/v2"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// Sizing for the live-set bloom filter: one entry added per live
+// account/storage entry visited, tuned so a mainnet-sized state trie stays comfortably under
+// 1% false positives. A false positive only means we keep an entry we didn't
+// need to - never that we delete something still live - so this is a
+// size/safety trade-off, not a correctness one.
+const (
+	stateBloomFalsePositiveRate = 0.01
+	stateBloomExpectedNodeCount = 512 * 1024 * 1024
+)
+
+// stateBloom is a probabilistic record of the live HashedAccountsBucket and
+// HashedStorageBucket keys reachable from the state root(s) an offline
+// prune is keeping. Unlike go-ethereum, whose trie nodes are stored
+// content-addressed and can be pruned by a bloom of node hashes,
+// turbo-geth's state is flat and path-addressed: HashedAccountsBucket is
+// keyed by hash(address) and HashedStorageBucket by
+// hash(address)+incarnation+hash(location). bloom is keyed the same way, so
+// sweep can look an entry up by its raw bucket key.
+type stateBloom struct {
+	bloom *bloomfilter.Filter
+}
+
+func newStateBloom() (*stateBloom, error) {
+	f, err := bloomfilter.NewOptimal(stateBloomExpectedNodeCount, stateBloomFalsePositiveRate)
+	if err != nil {
+		return nil, err
+	}
+	return &stateBloom{bloom: f}, nil
+}
+
+func (b *stateBloom) put(key []byte)          { b.bloom.Add(bloomfilter.NewHash(key)) }
+func (b *stateBloom) contain(key []byte) bool { return b.bloom.Contains(bloomfilter.NewHash(key)) }
+
+// pruningInProgressKey stores the target root of an in-flight offline prune.
+// It is written before the live-set bloom is built and cleared once deletion
+// finishes, so its presence on startup means a previous run was interrupted.
+// Prune then runs again against that same target, rebuilding the bloom and
+// re-sweeping from scratch, and refuses to start a prune for any other root.
+var pruningInProgressKey = []byte("offline-prune-target-root")
+
+// OfflinePruner reconstructs live state from a snapshot at a chosen target
+// block and deletes every trie/state entry that is not reachable from it.
+// Unlike BasicPruner, which only trims change sets while the node is
+// running, OfflinePruner is meant to be run once, offline, to reclaim
+// historic-state disk usage in one shot - this is what backs the
+// `turbo-geth snapshot prune-state` subcommand.
+type OfflinePruner struct {
+	db          ethdb.Database
+	genesisRoot common.Hash
+}
+
+func NewOfflinePruner(db ethdb.Database, genesisRoot common.Hash) *OfflinePruner {
+	return &OfflinePruner{db: db, genesisRoot: genesisRoot}
+}
+
+// Prune keeps every hashed account/storage entry reachable from targetRoot
+// (plus the genesis state) and deletes the rest, drops the intermediate trie
+// hash buckets wholesale (see sweep), then compacts the underlying KV if the
+// database supports CompactRange.
+func (p *OfflinePruner) Prune(targetRoot common.Hash) error {
+	inProgress, err := p.readInProgressRoot()
+	if err != nil {
+		return err
+	}
+	if inProgress != (common.Hash{}) && inProgress != targetRoot {
+		return fmt.Errorf("a prune targeting root %x is already in progress, refusing to start a new one for %x", inProgress, targetRoot)
+	}
+	if inProgress == (common.Hash{}) {
+		if err := p.writeInProgressRoot(targetRoot); err != nil {
+			return err
+		}
+	} else {
+		log.Warn("Resuming interrupted offline prune", "target", targetRoot)
+	}
+
+	bloom, err := newStateBloom()
+	if err != nil {
+		return err
+	}
+	if err := p.markLive(targetRoot, bloom); err != nil {
+		return err
+	}
+	if err := p.markLive(p.genesisRoot, bloom); err != nil {
+		return err
+	}
+
+	if err := p.sweep(bloom); err != nil {
+		return err
+	}
+	if err := p.clearInProgressRoot(); err != nil {
+		return err
+	}
+
+	if compactor, ok := p.db.(interface{ CompactRange() error }); ok {
+		log.Info("Compacting database after offline prune")
+		return compactor.CompactRange()
+	}
+	return nil
+}
+
+// markLive walks the account trie reachable from root and records the
+// HashedAccountsBucket key of every live account in bloom. For every
+// account that is a contract (non-zero incarnation with a non-empty storage
+// root), it also recurses into that account's own storage trie and records
+// the HashedStorageBucket key of every live slot. Without this second,
+// per-account level, live contract storage would never be marked and sweep
+// would delete it all on the very first run.
+func (p *OfflinePruner) markLive(root common.Hash, bloom *stateBloom) error {
+	if root == (common.Hash{}) {
+		return nil
+	}
+	t, err := trie.NewStateTrie(root, trie.NewDatabase(p.db))
+	if err != nil {
+		return err
+	}
+	it := trie.NewNodeIterator(t)
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		addrHash := it.LeafKey()
+		bloom.put(addrHash)
+
+		var acc accounts.Account
+		if err := acc.DecodeForStorage(it.LeafBlob()); err != nil {
+			return fmt.Errorf("decoding account at %x: %w", addrHash, err)
+		}
+		if acc.Incarnation == 0 || acc.Root == (common.Hash{}) || acc.Root == emptyStorageRoot {
+			continue
+		}
+		if err := p.markLiveStorage(addrHash, acc.Incarnation, acc.Root, bloom); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// emptyStorageRoot is the root of an empty Merkle-Patricia trie
+// (keccak256(rlp(""))), i.e. the Root a freshly-created account starts
+// with before it has any storage.
+var emptyStorageRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+// markLiveStorage walks a single contract's storage trie and records the
+// composite HashedStorageBucket key of every live slot in bloom.
+func (p *OfflinePruner) markLiveStorage(addrHash []byte, incarnation uint64, storageRoot common.Hash, bloom *stateBloom) error {
+	t, err := trie.New(storageRoot, trie.NewDatabase(p.db))
+	if err != nil {
+		return err
+	}
+	it := trie.NewNodeIterator(t)
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		bloom.put(hashedStorageKey(addrHash, incarnation, it.LeafKey()))
+	}
+	return it.Error()
+}
+
+// hashedStorageKey builds a HashedStorageBucket key out of its components,
+// mirroring dbutils.CompositeStorageKeySuffix's address+incarnation+location
+// layout but over the hashed address/location turbo-geth actually stores
+// live state under.
+func hashedStorageKey(addrHash []byte, incarnation uint64, locHash []byte) []byte {
+	key := make([]byte, len(addrHash)+8+len(locHash))
+	n := copy(key, addrHash)
+	binary.BigEndian.PutUint64(key[n:], incarnation)
+	n += 8
+	copy(key[n:], locHash)
+	return key
+}
+
+// sweep deletes any HashedAccountsBucket/HashedStorageBucket entry whose key
+// is absent from bloom. TrieOfAccountsBucket/TrieOfStorageBucket cache
+// intermediate hashes keyed by nibbled trie prefixes, not by account/storage
+// identity, so they cannot be checked against the same bloom - but they are
+// a pure, always-regenerable derived cache, so it is simplest and safest to
+// drop them wholesale here and let them be rebuilt lazily rather than
+// attempting to prune them selectively against a mismatched key space.
+func (p *OfflinePruner) sweep(bloom *stateBloom) error {
+	batch := p.db.NewBatch()
+	for _, bucket := range []string{dbutils.HashedAccountsBucket, dbutils.HashedStorageBucket} {
+		bucket := bucket
+		err := p.db.Walk(bucket, []byte{}, 0, func(key, _ []byte) (bool, error) {
+			if bloom.contain(key) {
+				return true, nil
+			}
+			if err := batch.Delete(bucket, key, nil); err != nil {
+				return false, err
+			}
+			if batch.BatchSize() >= DeleteLimit {
+				if err := batch.Commit(); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, bucket := range []string{dbutils.TrieOfAccountsBucket, dbutils.TrieOfStorageBucket} {
+		bucket := bucket
+		err := p.db.Walk(bucket, []byte{}, 0, func(key, _ []byte) (bool, error) {
+			if err := batch.Delete(bucket, key, nil); err != nil {
+				return false, err
+			}
+			if batch.BatchSize() >= DeleteLimit {
+				if err := batch.Commit(); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit()
+}
+
+func (p *OfflinePruner) readInProgressRoot() (common.Hash, error) {
+	data, err := p.db.Get(dbutils.DatabaseInfoBucket, pruningInProgressKey)
+	if err != nil && !ethdb.IsNotFoundErr(err) {
+		return common.Hash{}, err
+	}
+	if len(data) != common.HashLength {
+		return common.Hash{}, nil
+	}
+	return common.BytesToHash(data), nil
+}
+
+func (p *OfflinePruner) writeInProgressRoot(root common.Hash) error {
+	return p.db.Put(dbutils.DatabaseInfoBucket, pruningInProgressKey, root.Bytes())
+}
+
+func (p *OfflinePruner) clearInProgressRoot() error {
+	return p.db.Delete(dbutils.DatabaseInfoBucket, pruningInProgressKey)
+}
@@ -0,0 +1,28 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestHashedStorageKey(t *testing.T) {
+	addrHash := bytes.Repeat([]byte{0xaa}, 32)
+	locHash := bytes.Repeat([]byte{0xbb}, 32)
+	const incarnation = 7
+
+	key := hashedStorageKey(addrHash, incarnation, locHash)
+
+	if len(key) != len(addrHash)+8+len(locHash) {
+		t.Fatalf("unexpected key length: got %d", len(key))
+	}
+	if !bytes.Equal(key[:32], addrHash) {
+		t.Errorf("address hash prefix mismatch")
+	}
+	if got := binary.BigEndian.Uint64(key[32:40]); got != incarnation {
+		t.Errorf("incarnation = %d, want %d", got, incarnation)
+	}
+	if !bytes.Equal(key[40:], locHash) {
+		t.Errorf("location hash suffix mismatch")
+	}
+}
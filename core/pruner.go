@@ -1,11 +1,16 @@
 package core
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/RoaringBitmap/roaring/roaring64"
+
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -17,45 +22,221 @@ import (
 
 const DeleteLimit = 70000
 
+// defaultPruneBufferLimit bounds how many bytes of pending delete keys the
+// pruner keeps in memory before it schedules them for deletion. It is only
+// used when CacheConfig.PruneBufferLimit is left at zero.
+const defaultPruneBufferLimit = 32 * 1024 * 1024
+
+// pruneBatchQueueSize is the depth of the channel connecting the walker to
+// the deleter. Once it is full, pushKey's flush blocks the walker - this is
+// the pipeline's backpressure.
+const pruneBatchQueueSize = 4
+
 type BlockChainer interface {
 	CurrentBlock() *types.Block
 }
 
+// PruneMode selects how a pruningLoop tick waits on its deletes.
+type PruneMode int
+
+const (
+	// PruneModeSync blocks the pruning loop until every batch scheduled by
+	// the current tick has committed before starting the next tick.
+	PruneModeSync PruneMode = iota
+	// PruneModeAsync schedules batches on the deleter goroutine and lets the
+	// next tick start walking immediately; previous batches keep draining in
+	// the background.
+	PruneModeAsync
+)
+
+// pruneClass identifies an independently-retained category of prunable
+// data. Each class is driven by its own retention window (see
+// BasicPruner.retentions) so, e.g., an RPC-serving node can keep 90 days of
+// transactions/receipts while aggressively pruning intermediate trie
+// hashes - something a single global BlocksBeforePruning cannot express.
+type pruneClass int
+
+const (
+	classAccountHistory pruneClass = iota
+	classStorageHistory
+	classTransactionHistory
+	classReceipt
+	classIntermediateTrieHash
+)
+
+var allPruneClasses = []pruneClass{
+	classAccountHistory,
+	classStorageHistory,
+	classTransactionHistory,
+	classReceipt,
+	classIntermediateTrieHash,
+}
+
+// implementedPruneClasses are the classes Prune actually walks today.
+// prunedFloorLocked floors LastPrunedBlockNum across only these: a class
+// with no walker yet (transaction history, receipts, intermediate trie
+// hashes) keeps its retention/watermark bookkeeping ready for when its
+// walker lands, but its watermark is frozen at its Start()-time value
+// forever, so including it in the floor would pin LastPrunedBlockNum - and
+// everything that reads it, including Progress() and the value persisted
+// by WriteLastPrunedBlockNum - at that value for the life of the process.
+var implementedPruneClasses = []pruneClass{
+	classAccountHistory,
+	classStorageHistory,
+}
+
+func (c pruneClass) String() string {
+	switch c {
+	case classAccountHistory:
+		return "account-history"
+	case classStorageHistory:
+		return "storage-history"
+	case classTransactionHistory:
+		return "transaction-history"
+	case classReceipt:
+		return "receipt"
+	case classIntermediateTrieHash:
+		return "intermediate-trie-hash"
+	default:
+		return "unknown"
+	}
+}
+
+// blockRange is the [from, to] window a single pruning pass covers for one
+// pruneClass.
+type blockRange struct {
+	from, to uint64
+}
+
+// classCompletion marks that every key belonging to class up to block to has
+// been pushed into the flush pipeline. It rides along with the last flush
+// item of a class's walk so the deleter can only advance that class's
+// watermark once the corresponding batch has actually committed.
+type classCompletion struct {
+	class pruneClass
+	to    uint64
+}
+
+// flushItem is what travels over batchCh: a group of delete batches plus,
+// optionally, the class watermarks that are safe to advance once this item
+// commits.
+type flushItem struct {
+	batches     []Batch
+	completions []classCompletion
+}
+
+// PrunerStatus is a point-in-time snapshot of the pruner's progress, meant
+// to be polled (e.g. over JSON-RPC) so operators don't have to tail logs to
+// see whether pruning is keeping up.
+type PrunerStatus struct {
+	LastPrunedBlock    uint64
+	CurrentTarget      uint64
+	PendingKeys        uint64
+	BufferBytes        uint64
+	LastRunDuration    time.Duration
+	LastRunKeysDeleted uint64
+}
+
 func NewBasicPruner(database ethdb.Database, chainer BlockChainer, config *CacheConfig) (*BasicPruner, error) {
 	if config.BlocksToPrune == 0 || config.PruneTimeout.Seconds() < 1 {
 		return nil, fmt.Errorf("incorrect config BlocksToPrune - %v, PruneTimeout - %v", config.BlocksToPrune, config.PruneTimeout.Seconds())
 	}
 
-	return &BasicPruner{
-		wg:                 new(sync.WaitGroup),
-		db:                 database,
-		chain:              chainer,
-		config:             config,
-		LastPrunedBlockNum: 0,
-		stop:               make(chan struct{}, 1),
-	}, nil
+	bufferLimit := config.PruneBufferLimit
+	if bufferLimit == 0 {
+		bufferLimit = defaultPruneBufferLimit
+	}
+
+	p := &BasicPruner{
+		wg:                new(sync.WaitGroup),
+		db:                database,
+		chain:             chainer,
+		config:            config,
+		stop:              make(chan struct{}, 1),
+		buffer:            newNodeBuffer(int(bufferLimit)),
+		batchCh:           make(chan flushItem, pruneBatchQueueSize),
+		lastPrunedByClass: make(map[pruneClass]uint64, len(allPruneClasses)),
+	}
+
+	if config.Freezer != nil && config.Freezer.Path != "" {
+		f, err := openFreezer(config.Freezer.Path)
+		if err != nil {
+			return nil, fmt.Errorf("opening freezer at %q: %w", config.Freezer.Path, err)
+		}
+		p.freezer = f
+	}
+
+	return p, nil
 }
 
 type BasicPruner struct {
 	wg   *sync.WaitGroup
 	stop chan struct{}
 
-	db                 ethdb.Database
-	chain              BlockChainer
+	db    ethdb.Database
+	chain BlockChainer
+
+	// mu guards every field below that is shared between pruningLoop and
+	// deleteLoop: lastPrunedByClass/LastPrunedBlockNum are only ever
+	// advanced by deleteLoop, once a batch has actually committed, but both
+	// goroutines (and Progress callers) read them.
+	mu sync.Mutex
+	// LastPrunedBlockNum is the conservative floor over every implemented
+	// pruneClass's own progress: the oldest block number that is guaranteed
+	// to have been pruned for every data class with a walker. It is what
+	// gets persisted and read back on restart.
 	LastPrunedBlockNum uint64
-	config             *CacheConfig
+	lastPrunedByClass  map[pruneClass]uint64
+	status             PrunerStatus
+
+	keysThisRun int64
+	runStart    time.Time
+
+	config *CacheConfig
+
+	buffer  *nodebuffer
+	batchCh chan flushItem
+	flushWg sync.WaitGroup
+
+	// freezer and frozenBlockNum are nil/zero unless config.Freezer is set.
+	freezer        *freezer
+	frozenBlockNum uint64
 }
 
 func (p *BasicPruner) Start() error {
 	db := p.db
 	p.LastPrunedBlockNum = p.ReadLastPrunedBlockNum()
-	p.wg.Add(1)
+	for _, class := range allPruneClasses {
+		p.lastPrunedByClass[class] = p.LastPrunedBlockNum
+	}
+	p.status.LastPrunedBlock = p.LastPrunedBlockNum
+	if p.freezer != nil {
+		progress := p.readFreezerProgress()
+		if err := p.freezer.truncateTo(progress.itemCount); err != nil {
+			return fmt.Errorf("repairing ancient tables: %w", err)
+		}
+		p.frozenBlockNum = progress.blockNum
+	}
+	p.wg.Add(2)
+	go p.deleteLoop()
 	go p.pruningLoop(db)
 	log.Info("Pruner started")
 
 	return nil
 }
 
+// retentions returns the configured retention window, in blocks, for every
+// pruneClass.
+func (p *BasicPruner) retentions() map[pruneClass]uint64 {
+	return map[pruneClass]uint64{
+		classAccountHistory:       p.config.AccountHistoryRetention,
+		classStorageHistory:       p.config.StorageHistoryRetention,
+		classTransactionHistory:   p.config.TransactionHistoryRetention,
+		classReceipt:              p.config.ReceiptRetention,
+		classIntermediateTrieHash: p.config.IntermediateTrieHashRetention,
+	}
+}
+
 func (p *BasicPruner) pruningLoop(db ethdb.Database) {
 	prunerRun := time.NewTicker(p.config.PruneTimeout)
 	saveLastPrunedBlockNum := time.NewTicker(time.Minute * 5)
@@ -65,43 +246,95 @@ func (p *BasicPruner) pruningLoop(db ethdb.Database) {
 	for {
 		select {
 		case <-p.stop:
-			p.WriteLastPrunedBlockNum(p.LastPrunedBlockNum)
+			p.Flush()
+			p.WaitFlushed()
+			p.WriteLastPrunedBlockNum(p.lastPrunedBlockNum())
+			close(p.batchCh)
+			if p.freezer != nil {
+				if err := p.freezer.close(); err != nil {
+					log.Error("Closing freezer", "err", err)
+				}
+			}
 			log.Info("Pruning stopped")
 			return
 		case <-saveLastPrunedBlockNum.C:
-			log.Info("Save last pruned block num", "num", p.LastPrunedBlockNum)
-			p.WriteLastPrunedBlockNum(p.LastPrunedBlockNum)
+			num := p.lastPrunedBlockNum()
+			log.Info("Save last pruned block num", "num", num)
+			p.WriteLastPrunedBlockNum(num)
 		case <-prunerRun.C:
 			cb := p.chain.CurrentBlock()
 			if cb == nil || cb.Number() == nil {
 				continue
 			}
-			from, to, ok := calculateNumOfPrunedBlocks(cb.Number().Uint64(), p.LastPrunedBlockNum, p.config.BlocksBeforePruning, p.config.BlocksToPrune)
-			if !ok {
+			current := cb.Number().Uint64()
+
+			if p.freezer != nil && current > p.config.BlocksBeforeFreezing && current-p.config.BlocksBeforeFreezing > p.frozenBlockNum {
+				freezeTo := current - p.config.BlocksBeforeFreezing
+				log.Debug("Freezing blocks", "from", p.frozenBlockNum+1, "to", freezeTo)
+				if err := p.MoveToAncient(p.frozenBlockNum+1, freezeTo); err != nil {
+					log.Error("Freezing error", "err", err)
+					return
+				}
+				p.frozenBlockNum = freezeTo
+			}
+
+			ranges := make(map[pruneClass]blockRange)
+			p.mu.Lock()
+			for class, retention := range p.retentions() {
+				from, to, ok := calculateNumOfPrunedBlocks(current, p.lastPrunedByClass[class], retention, p.config.BlocksToPrune)
+				// With a freezer configured, nothing past the last frozen
+				// block is pruned.
+				if ok && p.freezer != nil && to > p.frozenBlockNum {
+					to = p.frozenBlockNum
+					ok = to > from
+				}
+				if ok {
+					ranges[class] = blockRange{from: from, to: to}
+				}
+			}
+			p.mu.Unlock()
+			if len(ranges) == 0 {
 				continue
 			}
-			log.Debug("Pruning history", "from", from, "to", to)
-			err := Prune(db, from, to)
-			if err != nil {
+			log.Debug("Pruning history", "classes", len(ranges))
+			if err := p.Prune(ranges); err != nil {
 				log.Error("Pruning error", "err", err)
 				return
 			}
-			p.LastPrunedBlockNum = to
 		}
 	}
 }
 
-func calculateNumOfPrunedBlocks(currentBlock, lastPrunedBlock uint64, blocksBeforePruning uint64, blocksBatch uint64) (uint64, uint64, bool) {
+func (p *BasicPruner) lastPrunedBlockNum() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.LastPrunedBlockNum
+}
+
+// prunedFloorLocked returns the lowest lastPrunedByClass watermark across
+// implementedPruneClasses, i.e. the highest block number that every class
+// with an actual walker has pruned up to. Caller must hold p.mu.
+func (p *BasicPruner) prunedFloorLocked() uint64 {
+	floor := uint64(math.MaxUint64)
+	for _, class := range implementedPruneClasses {
+		if v := p.lastPrunedByClass[class]; v < floor {
+			floor = v
+		}
+	}
+	return floor
+}
+
+func calculateNumOfPrunedBlocks(currentBlock, lastPrunedBlock uint64, retention uint64, blocksBatch uint64) (uint64, uint64, bool) {
 	//underflow see https://github.com/ledgerwatch/turbo-geth/issues/115
 	if currentBlock <= lastPrunedBlock {
 		return lastPrunedBlock, lastPrunedBlock, false
 	}
 
 	diff := currentBlock - lastPrunedBlock
-	if diff <= blocksBeforePruning {
+	if diff <= retention {
 		return lastPrunedBlock, lastPrunedBlock, false
 	}
-	diff = diff - blocksBeforePruning
+	diff = diff - retention
 	switch {
 	case diff >= blocksBatch:
 		return lastPrunedBlock, lastPrunedBlock + blocksBatch, true
@@ -135,10 +368,53 @@ func (p *BasicPruner) WriteLastPrunedBlockNum(num uint64) {
 	}
 }
 
-func Prune(db ethdb.Database, blockNumFrom uint64, blockNumTo uint64) error {
-	keysToRemove := newKeysToRemove()
+// Prune runs one pruning pass: every pruneClass present in ranges is walked
+// over its own [from, to] window and has its keys scheduled for deletion.
+// Classes without a bucket walker yet (transaction history, receipts,
+// intermediate trie hashes) still carry their own retention and watermark so
+// their windows are ready to drive a walker once that pruning path lands.
+//
+// In CacheConfig.PruneMode PruneModeSync, Prune blocks until every scheduled
+// batch has committed before returning, so LastPrunedBlockNum reflects this
+// pass by the time the next tick starts walking. In PruneModeAsync it
+// returns as soon as the walk is done; deleteLoop keeps draining in the
+// background and advances the per-class watermarks (and LastPrunedBlockNum)
+// itself once each batch actually commits.
+func (p *BasicPruner) Prune(ranges map[pruneClass]blockRange) error {
+	atomic.StoreInt64(&p.keysThisRun, 0)
+	p.mu.Lock()
+	p.runStart = time.Now()
+	p.mu.Unlock()
+
+	if r, ok := ranges[classAccountHistory]; ok {
+		p.setCurrentTarget(r.to)
+		if err := p.pruneAccountHistory(r.from, r.to); err != nil {
+			return err
+		}
+	}
+	if r, ok := ranges[classStorageHistory]; ok {
+		p.setCurrentTarget(r.to)
+		if err := p.pruneStorageHistory(r.from, r.to); err != nil {
+			return err
+		}
+	}
+
+	if p.config.PruneMode == PruneModeAsync {
+		return nil
+	}
+	p.WaitFlushed()
+	return nil
+}
+
+func (p *BasicPruner) setCurrentTarget(to uint64) {
+	p.mu.Lock()
+	p.status.CurrentTarget = to
+	p.mu.Unlock()
+}
+
+func (p *BasicPruner) pruneAccountHistory(blockNumFrom, blockNumTo uint64) error {
 	dec := changeset.Mapper[dbutils.PlainAccountChangeSetBucket].Decode
-	err := db.Walk(dbutils.PlainAccountChangeSetBucket, []byte{}, 0, func(key, v []byte) (b bool, e error) {
+	err := p.db.Walk(dbutils.PlainAccountChangeSetBucket, []byte{}, 0, func(key, v []byte) (b bool, e error) {
 		timestamp, parsedK, _ := dec(key, v)
 		if timestamp < blockNumFrom {
 			return true, nil
@@ -147,17 +423,21 @@ func Prune(db ethdb.Database, blockNumFrom uint64, blockNumTo uint64) error {
 			return false, nil
 		}
 
-		keysToRemove.AccountChangeSet = append(keysToRemove.AccountChangeSet, common.CopyBytes(key))
+		p.pushKey(dbutils.PlainAccountChangeSetBucket, common.CopyBytes(key))
 		compKey, _ := dbutils.CompositeKeySuffix(parsedK, timestamp)
-		keysToRemove.AccountHistoryKeys = append(keysToRemove.AccountHistoryKeys, compKey)
+		p.pushKey(dbutils.AccountsHistoryBucket, compKey)
 		return true, nil
 	})
 	if err != nil {
 		return err
 	}
+	p.completeClass(classAccountHistory, blockNumTo)
+	return nil
+}
 
-	dec = changeset.Mapper[dbutils.PlainStorageChangeSetBucket].Decode
-	err = db.Walk(dbutils.PlainStorageChangeSetBucket, []byte{}, 0, func(key, v []byte) (b bool, e error) {
+func (p *BasicPruner) pruneStorageHistory(blockNumFrom, blockNumTo uint64) error {
+	dec := changeset.Mapper[dbutils.PlainStorageChangeSetBucket].Decode
+	err := p.db.Walk(dbutils.PlainStorageChangeSetBucket, []byte{}, 0, func(key, v []byte) (b bool, e error) {
 		timestamp, parsedK, _ := dec(key, v)
 		if timestamp < blockNumFrom {
 			return true, nil
@@ -166,150 +446,171 @@ func Prune(db ethdb.Database, blockNumFrom uint64, blockNumTo uint64) error {
 			return false, nil
 		}
 
-		keysToRemove.StorageChangeSet = append(keysToRemove.StorageChangeSet, common.CopyBytes(key))
-		//todo implement pruning for thin history
-		_ = parsedK
+		p.pushKey(dbutils.PlainStorageChangeSetBucket, common.CopyBytes(key))
 
+		address, incarnation, location, err := dbutils.ParseStoragePlainKey(parsedK)
+		if err != nil {
+			return false, err
+		}
+		compKey, err := dbutils.CompositeStorageKeySuffix(address, incarnation, location, timestamp)
+		if err != nil {
+			return false, err
+		}
+		if p.config.StorageHistoryChopMode {
+			if err := p.chopStorageHistoryIndex(compKey, blockNumFrom, blockNumTo); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		p.pushKey(dbutils.StorageHistoryBucket, compKey)
 		return true, nil
 	})
 	if err != nil {
 		return err
 	}
-	err = batchDelete(db, keysToRemove)
-	if err != nil {
-		return err
-	}
-
+	p.completeClass(classStorageHistory, blockNumTo)
 	return nil
 }
 
-func batchDelete(db ethdb.Database, keys *keysToRemove) error {
-	log.Debug("Removing: ", "accounts", len(keys.AccountHistoryKeys), "storage", len(keys.StorageHistoryKeys), "suffix", len(keys.AccountChangeSet))
-	iterator := LimitIterator(keys, DeleteLimit)
-	for iterator.HasMore() {
-		iterator.ResetLimit()
-		batch := db.NewBatch()
-		for {
-			key, bucketKey, ok := iterator.GetNext()
-			if !ok {
-				break
-			}
-			err := batch.Delete(bucketKey, key, nil)
-			if err != nil {
-				log.Warn("Unable to remove", "bucket", bucketKey, "addr", common.Bytes2Hex(key), "err", err)
-				continue
-			}
-		}
-		err := batch.Commit()
-		if err != nil {
-			return err
+// chopStorageHistoryIndex removes the [blockNumFrom, blockNumTo] suffix from
+// a thin-history index chunk instead of deleting the whole key. Index
+// entries are chunked roaring bitmaps of block numbers; a chunk that
+// straddles the pruned range still holds history for blocks after
+// blockNumTo, so deleting it outright would lose that history. When the
+// chunk ends up empty after chopping, it is scheduled for deletion like any
+// other key.
+func (p *BasicPruner) chopStorageHistoryIndex(key []byte, blockNumFrom, blockNumTo uint64) error {
+	v, err := p.db.Get(dbutils.StorageHistoryBucket, key)
+	if err != nil {
+		if ethdb.IsNotFoundErr(err) {
+			return nil
 		}
+		return err
 	}
-	return nil
-}
 
-func newKeysToRemove() *keysToRemove {
-	return &keysToRemove{
-		AccountHistoryKeys:       make(Keys, 0),
-		StorageHistoryKeys:       make(Keys, 0),
-		AccountChangeSet:         make(Keys, 0),
-		StorageChangeSet:         make(Keys, 0),
-		StorageKeys:              make(Keys, 0),
-		IntermediateTrieHashKeys: make(Keys, 0),
+	chopped, empty, err := chopBitmapRange(v, blockNumFrom, blockNumTo)
+	if err != nil {
+		return err
 	}
+	if empty {
+		p.pushKey(dbutils.StorageHistoryBucket, common.CopyBytes(key))
+		return nil
+	}
+	return p.db.Put(dbutils.StorageHistoryBucket, key, chopped)
 }
 
-type Keys [][]byte
-type Batch struct {
-	bucket string
-	keys   Keys
-}
-
-type keysToRemove struct {
-	AccountHistoryKeys       Keys
-	StorageHistoryKeys       Keys
-	AccountChangeSet         Keys
-	StorageChangeSet         Keys
-	StorageKeys              Keys
-	IntermediateTrieHashKeys Keys
-}
-
-func LimitIterator(k *keysToRemove, limit int) *limitIterator {
-	i := &limitIterator{
-		k:     k,
-		limit: limit,
+// chopBitmapRange removes [blockNumFrom, blockNumTo] from the roaring64
+// bitmap encoded in data and re-encodes what's left. It reports whether the
+// bitmap is empty afterwards, so the caller can delete the chunk outright
+// instead of rewriting it.
+func chopBitmapRange(data []byte, blockNumFrom, blockNumTo uint64) (chopped []byte, empty bool, err error) {
+	bm := roaring64.New()
+	if _, err := bm.ReadFrom(bytes.NewReader(data)); err != nil {
+		return nil, false, err
 	}
+	pruned := roaring64.New()
+	pruned.AddRange(blockNumFrom, blockNumTo+1)
+	bm.AndNot(pruned)
 
-	i.batches = []Batch{
-		{bucket: dbutils.AccountsHistoryBucket, keys: i.k.AccountHistoryKeys},
-		{bucket: dbutils.StorageHistoryBucket, keys: i.k.StorageHistoryKeys},
-		{bucket: dbutils.HashedStorageBucket, keys: i.k.StorageKeys},
-		{bucket: dbutils.PlainAccountChangeSetBucket, keys: i.k.AccountChangeSet},
-		{bucket: dbutils.PlainStorageChangeSetBucket, keys: i.k.StorageChangeSet},
+	if bm.IsEmpty() {
+		return nil, true, nil
 	}
-
-	return i
-}
-
-type limitIterator struct {
-	k             *keysToRemove
-	counter       uint64
-	currentBucket string
-	currentNum    int
-	limit         int
-	batches       []Batch
+	var buf bytes.Buffer
+	if _, err := bm.WriteTo(&buf); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), false, nil
 }
 
-func (i *limitIterator) GetNext() ([]byte, string, bool) {
-	if i.limit <= i.currentNum {
-		return nil, "", false
-	}
-	i.updateBucket()
-	if !i.HasMore() {
-		return nil, "", false
-	}
-	defer func() {
-		i.currentNum++
-		i.counter++
-	}()
-
-	for batchIndex, batch := range i.batches {
-		if batchIndex == len(i.batches)-1 {
-			break
-		}
-		if i.currentBucket == batch.bucket {
-			return batch.keys[i.currentNum], batch.bucket, true
-		}
+// pushKey adds key to the dirty buffer and schedules an async flush once the
+// buffer reaches its configured size.
+func (p *BasicPruner) pushKey(bucket string, key []byte) {
+	full := p.buffer.add(bucket, key)
+	prunerBufferBytesGauge.Update(int64(p.buffer.bytes()))
+	if full {
+		p.flushBuffer(nil)
 	}
-	return nil, "", false
 }
 
-func (i *limitIterator) ResetLimit() {
-	i.counter = 0
+// Flush schedules every currently buffered key for deletion, regardless of
+// whether the buffer has reached its size limit yet.
+func (p *BasicPruner) Flush() {
+	p.flushBuffer(nil)
 }
 
-func (i *limitIterator) HasMore() bool {
-	lastBatch := i.batches[len(i.batches)-1]
-	if i.currentBucket == lastBatch.bucket && len(lastBatch.keys) == i.currentNum {
-		return false
-	}
+// WaitFlushed blocks until every batch scheduled so far - by the buffer
+// filling up or by an explicit Flush - has been committed.
+func (p *BasicPruner) WaitFlushed() {
+	p.flushWg.Wait()
+}
 
-	return true
+// completeClass forces a flush of whatever is left in the buffer and
+// attaches a watermark completion to it, so class's lastPrunedByClass entry
+// only advances to `to` once that flush has actually committed.
+func (p *BasicPruner) completeClass(class pruneClass, to uint64) {
+	p.flushBuffer([]classCompletion{{class: class, to: to}})
 }
 
-func (i *limitIterator) updateBucket() {
-	if i.currentBucket == "" {
-		i.currentBucket = i.batches[0].bucket
+func (p *BasicPruner) flushBuffer(completions []classCompletion) {
+	batches := p.buffer.drain()
+	prunerBufferBytesGauge.Update(0)
+	if len(batches) == 0 && len(completions) == 0 {
+		return
 	}
+	p.flushWg.Add(1)
+	p.batchCh <- flushItem{batches: batches, completions: completions}
+}
 
-	for batchIndex, batch := range i.batches {
-		if batchIndex == len(i.batches)-1 {
-			break
+// deleteLoop is the single consumer of batchCh: it commits each flushed
+// group of batches as one KV batch, advances any watermarks the item
+// completes, and records flush latency and committed/dropped key counts.
+func (p *BasicPruner) deleteLoop() {
+	defer p.wg.Done()
+	for item := range p.batchCh {
+		start := time.Now()
+		batch := p.db.NewBatch()
+		var committed int64
+		for _, b := range item.batches {
+			for _, key := range b.keys {
+				if err := batch.Delete(b.bucket, key, nil); err != nil {
+					log.Warn("Unable to remove", "bucket", b.bucket, "key", common.Bytes2Hex(key), "err", err)
+					prunerKeysDroppedMeter.Mark(1)
+					continue
+				}
+				committed++
+			}
 		}
-
-		if i.currentBucket == batch.bucket && len(batch.keys) == i.currentNum {
-			i.currentBucket = i.batches[batchIndex+1].bucket
-			i.currentNum = 0
+		err := batch.Commit()
+		if err != nil {
+			log.Error("Pruner flush failed", "err", err)
+			prunerKeysDroppedMeter.Mark(committed)
+		} else {
+			prunerKeysCommittedMeter.Mark(committed)
+			atomic.AddInt64(&p.keysThisRun, committed)
+		}
+		prunerFlushLatencyTimer.UpdateSince(start)
+
+		// Only advance watermarks once the batch that deleted their data has
+		// actually committed - a crash here must never leave
+		// LastPrunedBlockNum ahead of what is really gone from disk.
+		if err == nil && len(item.completions) > 0 {
+			p.mu.Lock()
+			for _, c := range item.completions {
+				p.lastPrunedByClass[c.class] = c.to
+			}
+			p.LastPrunedBlockNum = p.prunedFloorLocked()
+			p.status.LastPrunedBlock = p.LastPrunedBlockNum
+			p.status.LastRunKeysDeleted = uint64(atomic.LoadInt64(&p.keysThisRun))
+			p.status.LastRunDuration = time.Since(p.runStart)
+			p.mu.Unlock()
 		}
+
+		p.flushWg.Done()
 	}
 }
+
+type Keys [][]byte
+type Batch struct {
+	bucket string
+	keys   Keys
+}
@@ -0,0 +1,15 @@
+package core
+
+// Progress returns a snapshot of the pruner's current state: how far pruning
+// has got (LastPrunedBlock, the floor across the data classes with a walker),
+// what it is working towards, and how much work is still sitting in the dirty
+// buffer.
+func (p *BasicPruner) Progress() PrunerStatus {
+	p.mu.Lock()
+	status := p.status
+	p.mu.Unlock()
+
+	status.PendingKeys = uint64(p.buffer.count())
+	status.BufferBytes = uint64(p.buffer.bytes())
+	return status
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+func encodeBitmap(t *testing.T, blocks ...uint64) []byte {
+	t.Helper()
+	bm := roaring64.New()
+	bm.AddMany(blocks)
+	var buf bytes.Buffer
+	if _, err := bm.WriteTo(&buf); err != nil {
+		t.Fatalf("encoding test bitmap: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decodeBitmap(t *testing.T, data []byte) []uint64 {
+	t.Helper()
+	bm := roaring64.New()
+	if _, err := bm.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatalf("decoding result bitmap: %v", err)
+	}
+	return bm.ToArray()
+}
+
+func TestChopBitmapRangeRemovesOnlyTheGivenRange(t *testing.T) {
+	data := encodeBitmap(t, 1, 2, 3, 10, 11, 20)
+
+	chopped, empty, err := chopBitmapRange(data, 2, 11)
+	if err != nil {
+		t.Fatalf("chopBitmapRange: %v", err)
+	}
+	if empty {
+		t.Fatalf("bitmap should still have entries outside the chopped range")
+	}
+
+	got := decodeBitmap(t, chopped)
+	want := []uint64{1, 20}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("chopBitmapRange result = %v, want %v", got, want)
+	}
+}
+
+func TestChopBitmapRangeReportsEmptyWhenFullyCovered(t *testing.T) {
+	data := encodeBitmap(t, 5, 6, 7)
+
+	chopped, empty, err := chopBitmapRange(data, 0, 100)
+	if err != nil {
+		t.Fatalf("chopBitmapRange: %v", err)
+	}
+	if !empty {
+		t.Errorf("expected empty=true when the whole bitmap falls inside the pruned range")
+	}
+	if chopped != nil {
+		t.Errorf("expected nil result bytes when empty, got %d bytes", len(chopped))
+	}
+}
+
+func TestChopBitmapRangeIsRangeInclusive(t *testing.T) {
+	data := encodeBitmap(t, 9, 10, 11)
+
+	chopped, empty, err := chopBitmapRange(data, 10, 10)
+	if err != nil {
+		t.Fatalf("chopBitmapRange: %v", err)
+	}
+	if empty {
+		t.Fatalf("bitmap should still have 9 and 11 left")
+	}
+	got := decodeBitmap(t, chopped)
+	if len(got) != 2 || got[0] != 9 || got[1] != 11 {
+		t.Errorf("chopBitmapRange(10,10) result = %v, want [9 11]", got)
+	}
+}
@@ -0,0 +1,10 @@
+package core
+
+import "github.com/ledgerwatch/turbo-geth/metrics"
+
+var (
+	prunerBufferBytesGauge   = metrics.NewRegisteredGauge("pruner/buffer/bytes", nil)
+	prunerFlushLatencyTimer  = metrics.NewRegisteredTimer("pruner/flush/latency", nil)
+	prunerKeysCommittedMeter = metrics.NewRegisteredMeter("pruner/keys/committed", nil)
+	prunerKeysDroppedMeter   = metrics.NewRegisteredMeter("pruner/keys/dropped", nil)
+)
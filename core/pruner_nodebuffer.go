@@ -0,0 +1,80 @@
+package core
+
+import "sync"
+
+// nodebuffer is the dirty-key buffer sitting between the pruner's walker and
+// its deleter goroutine. It coalesces duplicate keys within a bucket (a key
+// can be visited more than once while walking overlapping change-set
+// ranges) and tracks its own size in bytes so the pruner can flush on a
+// memory budget rather than a raw key count.
+type nodebuffer struct {
+	mu       sync.Mutex
+	maxBytes int
+	byteSize int
+	buckets  map[string]map[string]struct{}
+}
+
+func newNodeBuffer(maxBytes int) *nodebuffer {
+	return &nodebuffer{
+		maxBytes: maxBytes,
+		buckets:  make(map[string]map[string]struct{}),
+	}
+}
+
+// add records key as pending deletion from bucket and reports whether the
+// buffer has reached its configured limit and should be flushed.
+func (b *nodebuffer) add(bucket string, key []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys, ok := b.buckets[bucket]
+	if !ok {
+		keys = make(map[string]struct{})
+		b.buckets[bucket] = keys
+	}
+	k := string(key)
+	if _, dup := keys[k]; !dup {
+		keys[k] = struct{}{}
+		b.byteSize += len(bucket) + len(key)
+	}
+	return b.byteSize >= b.maxBytes
+}
+
+// bytes reports the buffer's current size in bytes.
+func (b *nodebuffer) bytes() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.byteSize
+}
+
+// count reports how many distinct keys are currently buffered.
+func (b *nodebuffer) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, keys := range b.buckets {
+		n += len(keys)
+	}
+	return n
+}
+
+// drain empties the buffer and returns one Batch per non-empty bucket.
+func (b *nodebuffer) drain() []Batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.buckets) == 0 {
+		return nil
+	}
+	batches := make([]Batch, 0, len(b.buckets))
+	for bucket, keys := range b.buckets {
+		ks := make(Keys, 0, len(keys))
+		for k := range keys {
+			ks = append(ks, []byte(k))
+		}
+		batches = append(batches, Batch{bucket: bucket, keys: ks})
+	}
+	b.buckets = make(map[string]map[string]struct{})
+	b.byteSize = 0
+	return batches
+}
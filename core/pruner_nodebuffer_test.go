@@ -0,0 +1,64 @@
+package core
+
+import "testing"
+
+func TestNodeBufferAddDedupesWithinBucket(t *testing.T) {
+	b := newNodeBuffer(1024)
+
+	if full := b.add("bucket", []byte("key1")); full {
+		t.Fatalf("buffer reported full well under its limit")
+	}
+	sizeAfterFirst := b.bytes()
+
+	if full := b.add("bucket", []byte("key1")); full {
+		t.Fatalf("buffer reported full well under its limit")
+	}
+	if got := b.bytes(); got != sizeAfterFirst {
+		t.Errorf("duplicate key changed buffer size: got %d, want %d", got, sizeAfterFirst)
+	}
+	if got := b.count(); got != 1 {
+		t.Errorf("count = %d, want 1 after re-adding a duplicate key", got)
+	}
+
+	b.add("bucket", []byte("key2"))
+	if got := b.count(); got != 2 {
+		t.Errorf("count = %d, want 2 after adding a distinct key", got)
+	}
+}
+
+func TestNodeBufferAddReportsFullAtLimit(t *testing.T) {
+	b := newNodeBuffer(len("bucket") + len("key1"))
+
+	if full := b.add("bucket", []byte("key1")); !full {
+		t.Errorf("expected buffer to report full once maxBytes is reached")
+	}
+}
+
+func TestNodeBufferDrainEmptiesAndGroupsByBucket(t *testing.T) {
+	b := newNodeBuffer(1024)
+	b.add("bucketA", []byte("k1"))
+	b.add("bucketA", []byte("k2"))
+	b.add("bucketB", []byte("k3"))
+
+	batches := b.drain()
+	if len(batches) != 2 {
+		t.Fatalf("drain returned %d batches, want 2", len(batches))
+	}
+	total := 0
+	for _, batch := range batches {
+		total += len(batch.keys)
+	}
+	if total != 3 {
+		t.Errorf("drained %d keys total, want 3", total)
+	}
+
+	if got := b.count(); got != 0 {
+		t.Errorf("count after drain = %d, want 0", got)
+	}
+	if got := b.bytes(); got != 0 {
+		t.Errorf("bytes after drain = %d, want 0", got)
+	}
+	if batches := b.drain(); batches != nil {
+		t.Errorf("draining an empty buffer should return nil, got %v", batches)
+	}
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+type fakeChainer struct {
+	current *types.Block
+}
+
+func (f *fakeChainer) CurrentBlock() *types.Block { return f.current }
+
+func newTestPruner(t *testing.T, mode PruneMode) *BasicPruner {
+	t.Helper()
+	db := ethdb.NewMemDatabase()
+	t.Cleanup(func() { db.Close() })
+
+	config := &CacheConfig{
+		BlocksToPrune: 100,
+		PruneTimeout:  time.Hour,
+		PruneMode:     mode,
+	}
+	p, err := NewBasicPruner(db, &fakeChainer{}, config)
+	if err != nil {
+		t.Fatalf("NewBasicPruner: %v", err)
+	}
+	return p
+}
+
+// TestPruneSyncAdvancesWatermarkBeforeReturning exercises the crash-safety
+// invariant for PruneModeSync: Prune must not return until deleteLoop has
+// actually committed the batch that backs the new watermark.
+func TestPruneSyncAdvancesWatermarkBeforeReturning(t *testing.T) {
+	p := newTestPruner(t, PruneModeSync)
+
+	p.wg.Add(1)
+	go p.deleteLoop()
+	defer func() {
+		close(p.batchCh)
+		p.wg.Wait()
+	}()
+
+	if err := p.Prune(map[pruneClass]blockRange{classAccountHistory: {from: 0, to: 10}, classStorageHistory: {from: 0, to: 10}}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+
+	if got := p.lastPrunedBlockNum(); got != 10 {
+		t.Errorf("lastPrunedBlockNum() = %d, want 10 immediately after a synchronous Prune returns", got)
+	}
+}
+
+// TestPruneAsyncDefersWatermarkUntilDeleteLoopCommits exercises the same
+// invariant for PruneModeAsync, where the ordering guarantee shifts from
+// "Prune doesn't return early" to "the watermark never leads the batch that
+// justifies it" - deleteLoop is deliberately left unstarted until after
+// Prune returns, so the watermark is observably still at its old value.
+func TestPruneAsyncDefersWatermarkUntilDeleteLoopCommits(t *testing.T) {
+	p := newTestPruner(t, PruneModeAsync)
+
+	if err := p.Prune(map[pruneClass]blockRange{classAccountHistory: {from: 0, to: 10}, classStorageHistory: {from: 0, to: 10}}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+
+	if got := p.lastPrunedBlockNum(); got != 0 {
+		t.Fatalf("lastPrunedBlockNum() = %d, want 0 - nothing has committed yet, deleteLoop hasn't even started", got)
+	}
+
+	p.wg.Add(1)
+	go p.deleteLoop()
+	defer func() {
+		close(p.batchCh)
+		p.wg.Wait()
+	}()
+	p.WaitFlushed()
+
+	if got := p.lastPrunedBlockNum(); got != 10 {
+		t.Errorf("lastPrunedBlockNum() = %d, want 10 once deleteLoop has committed the completing batch", got)
+	}
+}
+
+// TestPruneStopFlushesPendingBatchesBeforePersisting drives the pruner
+// through its real Start/Stop lifecycle (pruningLoop + deleteLoop both
+// running) rather than calling deleteLoop directly, and checks that Stop
+// only persists LastPrunedBlockNum after the in-flight batch has actually
+// committed - the same crash-safety ordering, exercised end to end.
+func TestPruneStopFlushesPendingBatchesBeforePersisting(t *testing.T) {
+	p := newTestPruner(t, PruneModeSync)
+
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := p.Prune(map[pruneClass]blockRange{classAccountHistory: {from: 0, to: 10}, classStorageHistory: {from: 0, to: 10}}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if got := p.lastPrunedBlockNum(); got != 10 {
+		t.Fatalf("lastPrunedBlockNum() = %d, want 10 after a synchronous Prune", got)
+	}
+
+	p.Stop()
+
+	if got := p.ReadLastPrunedBlockNum(); got != 10 {
+		t.Errorf("ReadLastPrunedBlockNum() after Stop = %d, want 10 - Stop must persist the fully-committed watermark", got)
+	}
+}
@@ -0,0 +1,56 @@
+package core
+
+import "testing"
+
+func TestCalculateNumOfPrunedBlocksPerClass(t *testing.T) {
+	tests := []struct {
+		name            string
+		currentBlock    uint64
+		lastPrunedBlock uint64
+		retention       uint64
+		blocksBatch     uint64
+		wantTo          uint64
+		wantOk          bool
+	}{
+		{"nothing new since last prune", 100, 100, 10, 50, 100, false},
+		{"within retention window", 105, 100, 10, 50, 100, false},
+		{"batch capped by blocksBatch", 1000, 100, 10, 50, 150, true},
+		{"remaining diff smaller than blocksBatch", 130, 100, 10, 50, 120, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, ok := calculateNumOfPrunedBlocks(tt.currentBlock, tt.lastPrunedBlock, tt.retention, tt.blocksBatch)
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if from != tt.lastPrunedBlock {
+				t.Errorf("from = %d, want %d", from, tt.lastPrunedBlock)
+			}
+			if to != tt.wantTo {
+				t.Errorf("to = %d, want %d", to, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestPrunedFloorIgnoresUnimplementedClasses(t *testing.T) {
+	p := &BasicPruner{
+		lastPrunedByClass: map[pruneClass]uint64{
+			classAccountHistory:       100,
+			classStorageHistory:       80,
+			classTransactionHistory:   0,
+			classReceipt:              0,
+			classIntermediateTrieHash: 0,
+		},
+	}
+
+	// Unimplemented classes never advance past their Start()-time value, so
+	// a floor over allPruneClasses would stay pinned at 0 forever even
+	// though the implemented classes have made real progress.
+	if got := p.prunedFloorLocked(); got != 80 {
+		t.Errorf("prunedFloorLocked() = %d, want 80 (min of the implemented classes only)", got)
+	}
+}